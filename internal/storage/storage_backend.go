@@ -0,0 +1,78 @@
+// MIT License
+//
+// (C) Copyright [2022] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Backend is the interface every PCS storage driver implements. ETCDStorage
+// (which also covers the in-memory case, since hms-hmetcd provides both
+// behind the same Kvi handle) is the original and still the default driver;
+// Backend exists so PostgresStorage and ConsulStorage can be dropped in
+// alongside it without callers caring which one is live.
+type Backend interface {
+	Init(Logger *logrus.Logger) error
+	Ping() error
+	StorePowerStatus(p PowerStatusComponent) error
+	DeletePowerStatus(xname string) error
+	GetPowerStatus(xname string) (PowerStatusComponent, error)
+	GetAllPowerStatus() (PowerStatus, error)
+	WatchPowerStatus(ctx context.Context, xnamePrefix string) (<-chan PowerStatusEvent, error)
+}
+
+const (
+	storageBackendEnvVar   = "PCS_STORAGE_BACKEND"
+	storageBackendEtcd     = "etcd"
+	storageBackendMem      = "mem"
+	storageBackendPostgres = "postgres"
+	storageBackendConsul   = "consul"
+)
+
+// NewBackend selects and constructs a Backend based on PCS_STORAGE_BACKEND
+// (etcd|postgres|consul|mem). Unset or empty defaults to "etcd" so existing
+// deployments are unaffected; any other unrecognized value returns an error.
+func NewBackend(Logger *logrus.Logger) (Backend, error) {
+	kind := strings.ToLower(os.Getenv(storageBackendEnvVar))
+	switch kind {
+	case "", storageBackendEtcd:
+		b := &ETCDStorage{}
+		return b, b.Init(Logger)
+	case storageBackendMem:
+		b := &ETCDStorage{memOnly: true}
+		return b, b.Init(Logger)
+	case storageBackendPostgres:
+		b := &PostgresStorage{}
+		return b, b.Init(Logger)
+	case storageBackendConsul:
+		b := &ConsulStorage{}
+		return b, b.Init(Logger)
+	default:
+		return nil, fmt.Errorf("%s: unknown storage backend '%s'", storageBackendEnvVar, kind)
+	}
+}
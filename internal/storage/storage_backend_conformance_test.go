@@ -0,0 +1,140 @@
+// MIT License
+//
+// (C) Copyright [2022] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package storage
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// runBackendConformanceSuite exercises the common Backend contract -- the
+// same basic read/write/delete/watch behavior every driver (ETCD/mem,
+// Postgres, Consul) must provide. Every driver-specific test in this file
+// calls this with a constructor for that driver.
+func runBackendConformanceSuite(t *testing.T, newBackend func() (Backend, error)) {
+	b, err := newBackend()
+	if err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+
+	if err := b.Ping(); err != nil {
+		t.Fatalf("Ping: %v", err)
+	}
+
+	xname := "x0c0s0b0n0"
+	want := PowerStatusComponent{XName: xname}
+
+	t.Run("StoreAndGet", func(t *testing.T) {
+		if err := b.StorePowerStatus(want); err != nil {
+			t.Fatalf("StorePowerStatus: %v", err)
+		}
+		got, err := b.GetPowerStatus(xname)
+		if err != nil {
+			t.Fatalf("GetPowerStatus: %v", err)
+		}
+		if got.XName != want.XName {
+			t.Errorf("GetPowerStatus: got XName %q, want %q", got.XName, want.XName)
+		}
+	})
+
+	t.Run("GetAllIncludesStored", func(t *testing.T) {
+		pstats, err := b.GetAllPowerStatus()
+		if err != nil {
+			t.Fatalf("GetAllPowerStatus: %v", err)
+		}
+		found := false
+		for _, pcomp := range pstats.Status {
+			if pcomp.XName == xname {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("GetAllPowerStatus: %q not present in %d results", xname, len(pstats.Status))
+		}
+	})
+
+	t.Run("Watch", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		events, err := b.WatchPowerStatus(ctx, xname)
+		if err != nil {
+			t.Fatalf("WatchPowerStatus: %v", err)
+		}
+		if err := b.StorePowerStatus(PowerStatusComponent{XName: xname}); err != nil {
+			t.Fatalf("StorePowerStatus: %v", err)
+		}
+
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				t.Fatalf("Watch: event channel closed before an event arrived")
+			}
+			if ev.XName != xname {
+				t.Errorf("Watch: got event for %q, want %q", ev.XName, xname)
+			}
+		case <-ctx.Done():
+			t.Fatalf("Watch: timed out waiting for a PUT event")
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		if err := b.DeletePowerStatus(xname); err != nil {
+			t.Fatalf("DeletePowerStatus: %v", err)
+		}
+		if _, err := b.GetPowerStatus(xname); err == nil {
+			t.Errorf("GetPowerStatus: expected an error after DeletePowerStatus, got nil")
+		}
+	})
+}
+
+func TestETCDMemBackendConformance(t *testing.T) {
+	runBackendConformanceSuite(t, func() (Backend, error) {
+		b := &ETCDStorage{memOnly: true}
+		return b, b.Init(logrus.New())
+	})
+}
+
+func TestPostgresBackendConformance(t *testing.T) {
+	if _, ok := os.LookupEnv("PCS_POSTGRES_DSN"); !ok {
+		t.Skip("PCS_POSTGRES_DSN not set, skipping Postgres conformance test")
+	}
+	runBackendConformanceSuite(t, func() (Backend, error) {
+		b := &PostgresStorage{}
+		return b, b.Init(logrus.New())
+	})
+}
+
+func TestConsulBackendConformance(t *testing.T) {
+	if _, ok := os.LookupEnv("CONSUL_HTTP_ADDR"); !ok {
+		t.Skip("CONSUL_HTTP_ADDR not set, skipping Consul conformance test")
+	}
+	runBackendConformanceSuite(t, func() (Backend, error) {
+		b := &ConsulStorage{}
+		return b, b.Init(logrus.New())
+	})
+}
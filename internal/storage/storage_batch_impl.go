@@ -0,0 +1,145 @@
+// MIT License
+//
+// (C) Copyright [2022] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/Cray-HPE/hms-xname/xnametypes"
+)
+
+// This file adds bulk/CAS variants of StorePowerStatus/DeletePowerStatus for
+// callers (HSM bulk ingest, rack-level power events) that would otherwise
+// have to issue one call per xname themselves.
+//
+// The hmetcd.Kvi interface used elsewhere in this package has no exposed
+// multi-key transaction primitive, so StorePowerStatusBatch/
+// DeletePowerStatusBatch are NOT atomic or transactional: each key is still
+// its own independent Store/Delete round-trip, exactly as if the caller had
+// looped over StorePowerStatus/DeletePowerStatus themselves. A failure
+// partway through leaves every key before it already written/deleted, with
+// no rollback. The batch calls exist purely as a convenience API (one call
+// instead of a hand-rolled loop) and so a partial failure is reported
+// precisely -- they intentionally do not hold e.mutex for the whole batch,
+// since doing so would serialize every other StorePowerStatus/GetPowerStatus
+// call on this ETCDStorage behind it without buying real atomicity in
+// exchange. A true all-or-nothing multi-key write needs a direct ETCD v3
+// client txn, which is out of scope for this hmetcd-based package.
+
+// StorePowerStatusBatch stores every component in comps, one independent
+// kvStore call per xname. It is not transactional: if a store fails partway
+// through, every component before it in comps has already been written and
+// is not rolled back. The returned error, if any, names the xname that
+// failed and how many of comps were successfully stored before it. Like
+// StorePowerStatus, it refuses to write at all once a corruption alarm has
+// put storage into read-only mode.
+func (e *ETCDStorage) StorePowerStatusBatch(comps []PowerStatusComponent) error {
+	if e.isReadOnly() {
+		return ErrStorageCorrupt
+	}
+	for _, p := range comps {
+		if !(xnametypes.IsHMSCompIDValid(p.XName)) {
+			return fmt.Errorf("Error parsing '%s': invalid xname format.", p.XName)
+		}
+	}
+
+	for i, p := range comps {
+		key := fmt.Sprintf("%s/%s", keySegPowerState, p.XName)
+		if err := e.kvStore(key, p); err != nil {
+			e.Logger.Error(err)
+			return fmt.Errorf("StorePowerStatusBatch: stored %d of %d components before failing on '%s': %w", i, len(comps), p.XName, err)
+		}
+	}
+	return nil
+}
+
+// DeletePowerStatusBatch removes every xname in xnames, one independent
+// kvDelete call per xname, under the same non-atomic, partial-failure-
+// reporting contract as StorePowerStatusBatch, and the same read-only gate.
+func (e *ETCDStorage) DeletePowerStatusBatch(xnames []string) error {
+	if e.isReadOnly() {
+		return ErrStorageCorrupt
+	}
+	for _, xname := range xnames {
+		if !(xnametypes.IsHMSCompIDValid(xname)) {
+			return fmt.Errorf("Error parsing '%s': invalid xname format.", xname)
+		}
+	}
+
+	for i, xname := range xnames {
+		key := fmt.Sprintf("%s/%s", keySegPowerState, xname)
+		if err := e.kvDelete(key); err != nil {
+			e.Logger.Error(err)
+			return fmt.Errorf("DeletePowerStatusBatch: deleted %d of %d xnames before failing on '%s': %w", i, len(xnames), xname, err)
+		}
+	}
+	return nil
+}
+
+// StorePowerStatusCAS stores next in place of prev only if the currently
+// stored value for prev.XName still matches prev (byte-for-byte, after JSON
+// marshalling and decompression). It returns (true, nil) if the write
+// happened, (false, nil) if the stored value had already changed out from
+// under the caller, or a non-nil error if the read/write itself failed.
+func (e *ETCDStorage) StorePowerStatusCAS(prev, next PowerStatusComponent) (bool, error) {
+	if e.isReadOnly() {
+		return false, ErrStorageCorrupt
+	}
+	if !(xnametypes.IsHMSCompIDValid(prev.XName)) {
+		return false, fmt.Errorf("Error parsing '%s': invalid xname format.", prev.XName)
+	}
+	if prev.XName != next.XName {
+		return false, fmt.Errorf("StorePowerStatusCAS: xname mismatch between prev ('%s') and next ('%s')", prev.XName, next.XName)
+	}
+
+	wantData, err := json.Marshal(prev)
+	if err != nil {
+		return false, err
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	key := e.fixUpKey(fmt.Sprintf("%s/%s", keySegPowerState, prev.XName))
+	rawCurData, exists, err := e.kvHandle.Get(key)
+	if err != nil {
+		return false, err
+	}
+	if !exists {
+		return false, nil
+	}
+	curData, err := decompressEnvelope([]byte(rawCurData))
+	if err != nil {
+		return false, err
+	}
+	if string(curData) != string(wantData) {
+		return false, nil
+	}
+
+	if err := e.kvStoreLocked(fmt.Sprintf("%s/%s", keySegPowerState, prev.XName), next); err != nil {
+		e.Logger.Error(err)
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,176 @@
+// MIT License
+//
+// (C) Copyright [2022] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package storage
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func newTestBatchBackend(t *testing.T) *ETCDStorage {
+	t.Helper()
+	b := &ETCDStorage{memOnly: true}
+	if err := b.Init(logrus.New()); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	return b
+}
+
+func TestStorePowerStatusBatch(t *testing.T) {
+	b := newTestBatchBackend(t)
+	comps := []PowerStatusComponent{
+		{XName: "x0c0s0b0n0"},
+		{XName: "x0c0s0b0n1"},
+		{XName: "x0c0s0b0n2"},
+	}
+	if err := b.StorePowerStatusBatch(comps); err != nil {
+		t.Fatalf("StorePowerStatusBatch: %v", err)
+	}
+	for _, c := range comps {
+		if _, err := b.GetPowerStatus(c.XName); err != nil {
+			t.Errorf("GetPowerStatus(%q): %v", c.XName, err)
+		}
+	}
+}
+
+func TestStorePowerStatusBatchInvalidXNameAborts(t *testing.T) {
+	b := newTestBatchBackend(t)
+	comps := []PowerStatusComponent{
+		{XName: "x0c0s0b0n0"},
+		{XName: "not-a-valid-xname"},
+	}
+	if err := b.StorePowerStatusBatch(comps); err == nil {
+		t.Fatalf("StorePowerStatusBatch: expected an error for an invalid xname, got nil")
+	}
+	if _, err := b.GetPowerStatus("x0c0s0b0n0"); err == nil {
+		t.Errorf("GetPowerStatus: valid entry from a rejected batch was stored anyway")
+	}
+}
+
+func TestStorePowerStatusBatchReadOnly(t *testing.T) {
+	b := newTestBatchBackend(t)
+	b.raiseAlarm("corrupt")
+	defer b.DisarmAlarm("corrupt")
+
+	if err := b.StorePowerStatusBatch([]PowerStatusComponent{{XName: "x0c0s0b0n0"}}); err != ErrStorageCorrupt {
+		t.Errorf("StorePowerStatusBatch: got %v, want ErrStorageCorrupt", err)
+	}
+}
+
+func TestDeletePowerStatusBatch(t *testing.T) {
+	b := newTestBatchBackend(t)
+	comps := []PowerStatusComponent{
+		{XName: "x0c0s0b0n0"},
+		{XName: "x0c0s0b0n1"},
+	}
+	if err := b.StorePowerStatusBatch(comps); err != nil {
+		t.Fatalf("StorePowerStatusBatch: %v", err)
+	}
+
+	xnames := make([]string, len(comps))
+	for i, c := range comps {
+		xnames[i] = c.XName
+	}
+	if err := b.DeletePowerStatusBatch(xnames); err != nil {
+		t.Fatalf("DeletePowerStatusBatch: %v", err)
+	}
+	for _, xname := range xnames {
+		if _, err := b.GetPowerStatus(xname); err == nil {
+			t.Errorf("GetPowerStatus(%q): expected an error after DeletePowerStatusBatch, got nil", xname)
+		}
+	}
+}
+
+func TestStorePowerStatusCAS(t *testing.T) {
+	b := newTestBatchBackend(t)
+	xname := "x0c0s0b0n0"
+	orig := PowerStatusComponent{XName: xname, PowerState: "off"}
+	if err := b.StorePowerStatus(orig); err != nil {
+		t.Fatalf("StorePowerStatus: %v", err)
+	}
+
+	next := PowerStatusComponent{XName: xname, PowerState: "on"}
+	ok, err := b.StorePowerStatusCAS(orig, next)
+	if err != nil {
+		t.Fatalf("StorePowerStatusCAS: %v", err)
+	}
+	if !ok {
+		t.Fatalf("StorePowerStatusCAS: expected success against an unmodified value, got false")
+	}
+
+	got, err := b.GetPowerStatus(xname)
+	if err != nil {
+		t.Fatalf("GetPowerStatus: %v", err)
+	}
+	if got.PowerState != "on" {
+		t.Errorf("GetPowerStatus: got PowerState %q, want %q", got.PowerState, "on")
+	}
+}
+
+func TestStorePowerStatusCASMismatch(t *testing.T) {
+	b := newTestBatchBackend(t)
+	xname := "x0c0s0b0n0"
+	if err := b.StorePowerStatus(PowerStatusComponent{XName: xname, PowerState: "on"}); err != nil {
+		t.Fatalf("StorePowerStatus: %v", err)
+	}
+
+	staleView := PowerStatusComponent{XName: xname, PowerState: "off"}
+	ok, err := b.StorePowerStatusCAS(staleView, PowerStatusComponent{XName: xname, PowerState: "ready"})
+	if err != nil {
+		t.Fatalf("StorePowerStatusCAS: %v", err)
+	}
+	if ok {
+		t.Fatalf("StorePowerStatusCAS: expected failure against a stale prev value, got true")
+	}
+
+	got, err := b.GetPowerStatus(xname)
+	if err != nil {
+		t.Fatalf("GetPowerStatus: %v", err)
+	}
+	if got.PowerState != "on" {
+		t.Errorf("GetPowerStatus: CAS mismatch should not have modified the stored value, got PowerState %q", got.PowerState)
+	}
+}
+
+func TestStorePowerStatusCASMissingKey(t *testing.T) {
+	b := newTestBatchBackend(t)
+	ok, err := b.StorePowerStatusCAS(PowerStatusComponent{XName: "x0c0s0b0n9"}, PowerStatusComponent{XName: "x0c0s0b0n9", PowerState: "on"})
+	if err != nil {
+		t.Fatalf("StorePowerStatusCAS: %v", err)
+	}
+	if ok {
+		t.Errorf("StorePowerStatusCAS: expected failure when prev's key does not exist, got true")
+	}
+}
+
+func TestStorePowerStatusCASXNameMismatch(t *testing.T) {
+	b := newTestBatchBackend(t)
+	_, err := b.StorePowerStatusCAS(
+		PowerStatusComponent{XName: "x0c0s0b0n0"},
+		PowerStatusComponent{XName: "x0c0s0b0n1"},
+	)
+	if err == nil {
+		t.Errorf("StorePowerStatusCAS: expected an error for mismatched prev/next xnames, got nil")
+	}
+}
@@ -0,0 +1,179 @@
+// MIT License
+//
+// (C) Copyright [2022] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// This file adds transparent compression of values written through
+// kvStore/kvGet. Small values are left exactly as they were (a bare JSON
+// document, for readability in an etcdctl dump); values at or above the
+// configured threshold are wrapped in a small envelope carrying the
+// compression algorithm and a base64 payload. kvGet sniffs the envelope on
+// read so both forms can coexist in the same cluster during a rollout.
+
+const (
+	compressMinBytesDefault = 1024
+	compressAlgoDefault     = "none"
+)
+
+// kvCompressEnvelope is the on-the-wire wrapper for a compressed value. The
+// "c" field is left empty (and the struct is never written) for values that
+// don't meet the size threshold, so existing small records are unaffected.
+type kvCompressEnvelope struct {
+	C string `json:"c"`
+	V string `json:"v"`
+}
+
+var (
+	kvCompressBytesIn = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "pcs_kv_compress_bytes_in_total",
+		Help: "Total uncompressed bytes passed into the KV compression layer.",
+	})
+	kvCompressBytesOut = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "pcs_kv_compress_bytes_out_total",
+		Help: "Total bytes actually written to the KV store after compression.",
+	})
+)
+
+func compressMinBytes() int {
+	if v, ok := os.LookupEnv("PCS_KV_COMPRESS_MIN_BYTES"); ok {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			return n
+		}
+	}
+	return compressMinBytesDefault
+}
+
+func compressAlgo() string {
+	algo := strings.ToLower(os.Getenv("PCS_KV_COMPRESS_ALGO"))
+	switch algo {
+	case "gzip", "zstd", "none":
+		return algo
+	default:
+		return compressAlgoDefault
+	}
+}
+
+// compressEnvelope wraps data in a kvCompressEnvelope when it is at or
+// above the configured threshold and compression is enabled, otherwise it
+// returns data unchanged.
+func compressEnvelope(data []byte) ([]byte, error) {
+	kvCompressBytesIn.Add(float64(len(data)))
+
+	algo := compressAlgo()
+	if algo == "none" || len(data) < compressMinBytes() {
+		kvCompressBytesOut.Add(float64(len(data)))
+		return data, nil
+	}
+
+	compressed, err := compressBytes(algo, data)
+	if err != nil {
+		return nil, err
+	}
+
+	env := kvCompressEnvelope{
+		C: algo,
+		V: base64.StdEncoding.EncodeToString(compressed),
+	}
+	out, err := json.Marshal(env)
+	if err != nil {
+		return nil, err
+	}
+	kvCompressBytesOut.Add(float64(len(out)))
+	return out, nil
+}
+
+// decompressEnvelope reverses compressEnvelope. Values that aren't a
+// kvCompressEnvelope (i.e. anything stored before compression was enabled,
+// or below the threshold) are returned unchanged.
+func decompressEnvelope(data []byte) ([]byte, error) {
+	var env kvCompressEnvelope
+	if err := json.Unmarshal(data, &env); err != nil || env.C == "" {
+		return data, nil
+	}
+
+	compressed, err := base64.StdEncoding.DecodeString(env.V)
+	if err != nil {
+		return nil, err
+	}
+	return decompressBytes(env.C, compressed)
+}
+
+func compressBytes(algo string, data []byte) ([]byte, error) {
+	switch algo {
+	case "gzip":
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(data); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case "zstd":
+		enc, err := zstd.NewWriter(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer enc.Close()
+		return enc.EncodeAll(data, nil), nil
+	default:
+		return nil, fmt.Errorf("unknown compression algorithm '%s'", algo)
+	}
+}
+
+func decompressBytes(algo string, data []byte) ([]byte, error) {
+	switch algo {
+	case "gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		return ioutil.ReadAll(zr)
+	case "zstd":
+		dec, err := zstd.NewReader(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer dec.Close()
+		return dec.DecodeAll(data, nil)
+	default:
+		return nil, fmt.Errorf("unknown compression algorithm '%s'", algo)
+	}
+}
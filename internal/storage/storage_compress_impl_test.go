@@ -0,0 +1,145 @@
+// MIT License
+//
+// (C) Copyright [2022] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package storage
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+func withCompressEnv(t *testing.T, algo, minBytes string) {
+	t.Helper()
+	origAlgo, hadAlgo := os.LookupEnv("PCS_KV_COMPRESS_ALGO")
+	origMin, hadMin := os.LookupEnv("PCS_KV_COMPRESS_MIN_BYTES")
+	t.Cleanup(func() {
+		if hadAlgo {
+			os.Setenv("PCS_KV_COMPRESS_ALGO", origAlgo)
+		} else {
+			os.Unsetenv("PCS_KV_COMPRESS_ALGO")
+		}
+		if hadMin {
+			os.Setenv("PCS_KV_COMPRESS_MIN_BYTES", origMin)
+		} else {
+			os.Unsetenv("PCS_KV_COMPRESS_MIN_BYTES")
+		}
+	})
+	os.Setenv("PCS_KV_COMPRESS_ALGO", algo)
+	os.Setenv("PCS_KV_COMPRESS_MIN_BYTES", minBytes)
+}
+
+func TestCompressEnvelopeBelowThresholdUnchanged(t *testing.T) {
+	withCompressEnv(t, "gzip", "1024")
+	data := []byte("short value")
+	out, err := compressEnvelope(data)
+	if err != nil {
+		t.Fatalf("compressEnvelope: %v", err)
+	}
+	if !bytes.Equal(out, data) {
+		t.Errorf("compressEnvelope: value below threshold was modified, got %q, want %q", out, data)
+	}
+}
+
+func TestCompressEnvelopeDisabledUnchanged(t *testing.T) {
+	withCompressEnv(t, "none", "0")
+	data := bytes.Repeat([]byte("x"), 2048)
+	out, err := compressEnvelope(data)
+	if err != nil {
+		t.Fatalf("compressEnvelope: %v", err)
+	}
+	if !bytes.Equal(out, data) {
+		t.Errorf("compressEnvelope: value was modified with compression disabled")
+	}
+}
+
+func TestCompressDecompressRoundTripGzip(t *testing.T) {
+	withCompressEnv(t, "gzip", "0")
+	data := []byte(strings.Repeat("hello world ", 100))
+	compressed, err := compressEnvelope(data)
+	if err != nil {
+		t.Fatalf("compressEnvelope: %v", err)
+	}
+	if bytes.Equal(compressed, data) {
+		t.Errorf("compressEnvelope: value at or above threshold was not wrapped in an envelope")
+	}
+	got, err := decompressEnvelope(compressed)
+	if err != nil {
+		t.Fatalf("decompressEnvelope: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("decompressEnvelope: round trip mismatch, got %q, want %q", got, data)
+	}
+}
+
+func TestCompressDecompressRoundTripZstd(t *testing.T) {
+	withCompressEnv(t, "zstd", "0")
+	data := []byte(strings.Repeat("hello world ", 100))
+	compressed, err := compressEnvelope(data)
+	if err != nil {
+		t.Fatalf("compressEnvelope: %v", err)
+	}
+	if bytes.Equal(compressed, data) {
+		t.Errorf("compressEnvelope: value at or above threshold was not wrapped in an envelope")
+	}
+	got, err := decompressEnvelope(compressed)
+	if err != nil {
+		t.Fatalf("decompressEnvelope: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("decompressEnvelope: round trip mismatch, got %q, want %q", got, data)
+	}
+}
+
+func TestDecompressEnvelopePassesThroughPlainValue(t *testing.T) {
+	plain := []byte(`{"XName":"x0c0s0b0n0"}`)
+	got, err := decompressEnvelope(plain)
+	if err != nil {
+		t.Fatalf("decompressEnvelope: %v", err)
+	}
+	if !bytes.Equal(got, plain) {
+		t.Errorf("decompressEnvelope: plain (non-envelope) value was modified, got %q, want %q", got, plain)
+	}
+}
+
+func TestCompressAlgoInvalidFallsBackToDefault(t *testing.T) {
+	withCompressEnv(t, "bogus", "1024")
+	if got := compressAlgo(); got != compressAlgoDefault {
+		t.Errorf("compressAlgo: got %q for an unrecognized value, want default %q", got, compressAlgoDefault)
+	}
+}
+
+func TestCompressMinBytesInvalidFallsBackToDefault(t *testing.T) {
+	origMin, hadMin := os.LookupEnv("PCS_KV_COMPRESS_MIN_BYTES")
+	defer func() {
+		if hadMin {
+			os.Setenv("PCS_KV_COMPRESS_MIN_BYTES", origMin)
+		} else {
+			os.Unsetenv("PCS_KV_COMPRESS_MIN_BYTES")
+		}
+	}()
+	os.Setenv("PCS_KV_COMPRESS_MIN_BYTES", "not-a-number")
+	if got := compressMinBytes(); got != compressMinBytesDefault {
+		t.Errorf("compressMinBytes: got %d for an invalid value, want default %d", got, compressMinBytesDefault)
+	}
+}
@@ -0,0 +1,222 @@
+// MIT License
+//
+// (C) Copyright [2022] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Cray-HPE/hms-xname/xnametypes"
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/sirupsen/logrus"
+)
+
+// consulWatchRetryBackoff bounds how fast WatchPowerStatus retries its
+// blocking query after an error (e.g. Consul unreachable), so a persistent
+// outage doesn't spin a full CPU core.
+const consulWatchRetryBackoff = 2 * time.Second
+
+// ConsulStorage is an optional Backend driver backed by Consul's KV store,
+// selected via PCS_STORAGE_BACKEND=consul. It reuses the same "/pcs/..."
+// key layout as ETCDStorage so the two are easy to reason about side by
+// side, and emulates Watch via Consul's blocking-query support instead of a
+// native subscription.
+type ConsulStorage struct {
+	Logger *logrus.Logger
+	client *consulapi.Client
+}
+
+func (c *ConsulStorage) Init(Logger *logrus.Logger) error {
+	if Logger == nil {
+		c.Logger = logrus.New()
+	} else {
+		c.Logger = Logger
+	}
+
+	cfg := consulapi.DefaultConfig()
+	if addr, ok := os.LookupEnv("CONSUL_HTTP_ADDR"); ok {
+		cfg.Address = addr
+	}
+	client, err := consulapi.NewClient(cfg)
+	if err != nil {
+		return fmt.Errorf("connecting to consul: %v", err)
+	}
+	c.client = client
+	return nil
+}
+
+func (c *ConsulStorage) Ping() error {
+	_, err := c.client.Status().Leader()
+	return err
+}
+
+func (c *ConsulStorage) consulKey(xname string) string {
+	return strings.TrimPrefix(fmt.Sprintf("%s%s/%s", keyPrefix, keySegPowerState, xname), "/")
+}
+
+func (c *ConsulStorage) StorePowerStatus(p PowerStatusComponent) error {
+	if !(xnametypes.IsHMSCompIDValid(p.XName)) {
+		return fmt.Errorf("Error parsing '%s': invalid xname format.", p.XName)
+	}
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	_, err = c.client.KV().Put(&consulapi.KVPair{Key: c.consulKey(p.XName), Value: data}, nil)
+	if err != nil {
+		c.Logger.Error(err)
+	}
+	return err
+}
+
+func (c *ConsulStorage) DeletePowerStatus(xname string) error {
+	if !(xnametypes.IsHMSCompIDValid(xname)) {
+		return fmt.Errorf("Error parsing '%s': invalid xname format.", xname)
+	}
+	_, err := c.client.KV().Delete(c.consulKey(xname), nil)
+	if err != nil {
+		c.Logger.Error(err)
+	}
+	return err
+}
+
+func (c *ConsulStorage) GetPowerStatus(xname string) (PowerStatusComponent, error) {
+	var pcomp PowerStatusComponent
+	if !(xnametypes.IsHMSCompIDValid(xname)) {
+		return pcomp, fmt.Errorf("Error parsing '%s': invalid xname format.", xname)
+	}
+	kv, _, err := c.client.KV().Get(c.consulKey(xname), nil)
+	if err != nil {
+		c.Logger.Error(err)
+		return pcomp, err
+	}
+	if kv == nil {
+		return pcomp, fmt.Errorf("Key %s does not exist", xname)
+	}
+	err = json.Unmarshal(kv.Value, &pcomp)
+	return pcomp, err
+}
+
+func (c *ConsulStorage) GetAllPowerStatus() (PowerStatus, error) {
+	var pstats PowerStatus
+	prefix := strings.TrimPrefix(fmt.Sprintf("%s%s/", keyPrefix, keySegPowerState), "/")
+	kvs, _, err := c.client.KV().List(prefix, nil)
+	if err != nil {
+		c.Logger.Error(err)
+		return pstats, err
+	}
+	for _, kv := range kvs {
+		var pcomp PowerStatusComponent
+		if err := json.Unmarshal(kv.Value, &pcomp); err != nil {
+			c.Logger.Error(err)
+			continue
+		}
+		pstats.Status = append(pstats.Status, pcomp)
+	}
+	return pstats, nil
+}
+
+// WatchPowerStatus polls Consul's blocking-query KV list (List with
+// WaitIndex) for the powerstate prefix and diffs successive results,
+// publishing PUT/DELETE events until ctx is cancelled. Each send to out
+// blocks until the caller reads it or ctx is cancelled; unlike the etcd/mem
+// hub's non-blocking send, no event is dropped. Guarding the send with
+// ctx.Done() means that if the caller stops draining out, this goroutine
+// (and the underlying Consul blocking query) still exits on cancellation
+// instead of leaking forever.
+func (c *ConsulStorage) WatchPowerStatus(ctx context.Context, xnamePrefix string) (<-chan PowerStatusEvent, error) {
+	out := make(chan PowerStatusEvent, 64)
+	prefix := strings.TrimPrefix(fmt.Sprintf("%s%s/", keyPrefix, keySegPowerState), "/")
+
+	go func() {
+		defer close(out)
+		last := make(map[string]PowerStatusComponent)
+		var waitIndex uint64
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			default:
+			}
+
+			kvs, meta, err := c.client.KV().List(prefix, &consulapi.QueryOptions{
+				WaitIndex: waitIndex,
+				Context:   ctx,
+			})
+			if err != nil {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(consulWatchRetryBackoff):
+				}
+				continue
+			}
+			waitIndex = meta.LastIndex
+
+			current := make(map[string]PowerStatusComponent, len(kvs))
+			for _, kv := range kvs {
+				xname := strings.TrimPrefix(kv.Key, prefix)
+				var pcomp PowerStatusComponent
+				if err := json.Unmarshal(kv.Value, &pcomp); err != nil {
+					continue
+				}
+				current[xname] = pcomp
+			}
+
+			for xname, pcomp := range current {
+				if xnamePrefix != "" && !hasXnamePrefix(xname, xnamePrefix) {
+					continue
+				}
+				if prev, existed := last[xname]; !existed || prev != pcomp {
+					cur := pcomp
+					select {
+					case out <- PowerStatusEvent{Type: PowerStatusEventPut, XName: xname, Current: &cur}:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+			for xname, pcomp := range last {
+				if xnamePrefix != "" && !hasXnamePrefix(xname, xnamePrefix) {
+					continue
+				}
+				if _, stillPresent := current[xname]; !stillPresent {
+					p := pcomp
+					select {
+					case out <- PowerStatusEvent{Type: PowerStatusEventDelete, XName: xname, Previous: &p}:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+			last = current
+		}
+	}()
+
+	return out, nil
+}
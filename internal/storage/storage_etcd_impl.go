@@ -50,9 +50,18 @@ const (
 )
 
 type ETCDStorage struct {
-	Logger   *logrus.Logger
-	mutex    *sync.Mutex
-	kvHandle hmetcd.Kvi
+	Logger        *logrus.Logger
+	mutex         *sync.Mutex
+	kvHandle      hmetcd.Kvi
+	watchHubMutex sync.Mutex
+	watchHub      *powerStatusWatchHub
+	instID        string
+	alarmMutex    sync.Mutex
+	alarms        map[string]bool
+	stopIntegrity chan struct{}
+	memOnly       bool // true selects the in-memory hmetcd backend (PCS_STORAGE_BACKEND=mem)
+	leaseMutex    sync.Mutex
+	leases        *leasePool
 }
 
 func (e *ETCDStorage) fixUpKey(k string) string {
@@ -73,7 +82,18 @@ func (e *ETCDStorage) fixUpKey(k string) string {
 func (e *ETCDStorage) kvStore(key string, val interface{}) error {
 	e.mutex.Lock()
 	defer e.mutex.Unlock()
+	return e.kvStoreLocked(key, val)
+}
+
+// kvStoreLocked is kvStore's body, factored out so callers that already
+// hold e.mutex (e.g. StorePowerStatusCAS in storage_batch_impl.go, which
+// reads and then writes under a single lock acquisition) still get the same
+// compression treatment as a single-key store.
+func (e *ETCDStorage) kvStoreLocked(key string, val interface{}) error {
 	data, err := json.Marshal(val)
+	if err == nil {
+		data, err = compressEnvelope(data)
+	}
 	if err == nil {
 		realKey := e.fixUpKey(key)
 		err = e.kvHandle.Store(realKey, string(data))
@@ -84,11 +104,21 @@ func (e *ETCDStorage) kvStore(key string, val interface{}) error {
 func (e *ETCDStorage) kvGet(key string, val interface{}) error {
 	e.mutex.Lock()
 	defer e.mutex.Unlock()
+	return e.kvGetLocked(key, val)
+}
+
+// kvGetLocked is kvGet's body, factored out for callers that already hold
+// e.mutex.
+func (e *ETCDStorage) kvGetLocked(key string, val interface{}) error {
 	realKey := e.fixUpKey(key)
 	v, exists, err := e.kvHandle.Get(realKey)
 	if exists {
 		// We have a key, so val is valid.
-		err = json.Unmarshal([]byte(v), &val)
+		var data []byte
+		data, err = decompressEnvelope([]byte(v))
+		if err == nil {
+			err = json.Unmarshal(data, &val)
+		}
 	} else if err == nil {
 		// No key and no error.  We will return this condition as an error
 		err = fmt.Errorf("Key %s does not exist", key)
@@ -100,9 +130,15 @@ func (e *ETCDStorage) kvGet(key string, val interface{}) error {
 func (e *ETCDStorage) kvDelete(key string) error {
 	e.mutex.Lock()
 	defer e.mutex.Unlock()
+	return e.kvDeleteLocked(key)
+}
+
+// kvDeleteLocked is kvDelete's body, factored out for callers that already
+// hold e.mutex.
+func (e *ETCDStorage) kvDeleteLocked(key string) error {
 	realKey := e.fixUpKey(key)
 	e.Logger.Trace("delete" + realKey)
-	return e.kvHandle.Delete(e.fixUpKey(key))
+	return e.kvHandle.Delete(realKey)
 }
 
 func (e *ETCDStorage) Init(Logger *logrus.Logger) error {
@@ -115,6 +151,16 @@ func (e *ETCDStorage) Init(Logger *logrus.Logger) error {
 	}
 
 	e.mutex = &sync.Mutex{}
+
+	if e.memOnly {
+		e.kvHandle, kverr = hmetcd.Open(kvUrlMemDefault, "")
+		if kverr != nil {
+			e.kvHandle = nil
+			return fmt.Errorf("can't open in-memory KV store: %v", kverr)
+		}
+		return e.loadAlarms()
+	}
+
 	retries := kvRetriesDefault
 	host, hostExists := os.LookupEnv("ETCD_HOST")
 	if !hostExists {
@@ -145,7 +191,7 @@ func (e *ETCDStorage) Init(Logger *logrus.Logger) error {
 		e.kvHandle = nil
 		return fmt.Errorf("ETCD connection attempts exhausted, can't connect.")
 	}
-	return nil
+	return e.loadAlarms()
 }
 
 func (e *ETCDStorage) Ping() error {
@@ -159,6 +205,9 @@ func (e *ETCDStorage) Ping() error {
 }
 
 func (e *ETCDStorage) StorePowerStatus(p PowerStatusComponent) error {
+	if e.isReadOnly() {
+		return ErrStorageCorrupt
+	}
 	if !(xnametypes.IsHMSCompIDValid(p.XName)) {
 		return fmt.Errorf("Error parsing '%s': invalid xname format.",p.XName)
 	}
@@ -166,11 +215,18 @@ func (e *ETCDStorage) StorePowerStatus(p PowerStatusComponent) error {
 	err := e.kvStore(key, p)
 	if err != nil {
 		e.Logger.Error(err)
+	} else {
+		// A plain (re-)store means the caller wants p.XName's current
+		// value, not the lease it may have been written under previously.
+		e.clearLease(p.XName)
 	}
 	return err
 }
 
 func (e *ETCDStorage) DeletePowerStatus(xname string) error {
+	if e.isReadOnly() {
+		return ErrStorageCorrupt
+	}
 	if !(xnametypes.IsHMSCompIDValid(xname)) {
 		return fmt.Errorf("Error parsing '%s': invalid xname format.",xname)
 	}
@@ -178,6 +234,8 @@ func (e *ETCDStorage) DeletePowerStatus(xname string) error {
 	err := e.kvDelete(key)
 	if err != nil {
 		e.Logger.Error(err)
+	} else {
+		e.clearLease(xname)
 	}
 	return err
 }
@@ -203,7 +261,11 @@ func (e *ETCDStorage) GetAllPowerStatus() (PowerStatus, error) {
 	if err == nil {
 		for _, kv := range kvl {
 			var pcomp PowerStatusComponent
-			err = json.Unmarshal([]byte(kv.Value), &pcomp)
+			var data []byte
+			data, err = decompressEnvelope([]byte(kv.Value))
+			if err == nil {
+				err = json.Unmarshal(data, &pcomp)
+			}
 			if err != nil {
 				e.Logger.Error(err)
 			} else {
@@ -0,0 +1,328 @@
+// MIT License
+//
+// (C) Copyright [2022] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// This file adds a background integrity checker modelled on ETCD's own
+// corruption-alarm design: periodically hash every /pcs/powerstate/* key,
+// compare that hash against the other PCS replicas, and if they disagree
+// raise a persistent alarm that flips this ETCDStorage into a read-only
+// mode until an operator disarms it.
+//
+// hmetcd.Kvi has no native lease/election primitive, so "leader" here is
+// whichever replica's instance ID sorts first among the replicas that have
+// published a hash within the last staleReplicaIntervals check intervals --
+// cheap, and good
+// enough to avoid every replica redundantly comparing and alarming.
+
+const (
+	keySegIntegrity             = "/integrity/hash"
+	keySegAlarms                = "/alarms"
+	corruptCheckIntervalDefault = 5 * time.Minute
+	// A replica's published hash is considered stale (crashed/partitioned
+	// replica, not a live mismatch) once it's older than this many check
+	// intervals, and is pruned rather than compared or counted toward
+	// leader election.
+	staleReplicaIntervals = 3
+)
+
+// ErrStorageCorrupt is returned by StorePowerStatus/DeletePowerStatus once a
+// corrupt alarm has been raised, until that alarm is cleared via
+// DisarmAlarm.
+var ErrStorageCorrupt = errors.New("storage: corrupt alarm raised, refusing writes until disarmed")
+
+// replicaHash is what each replica publishes under
+// /pcs/integrity/hash/<instanceID>. Timestamp lets readers tell a crashed
+// replica's last hash (stale) apart from a live disagreement.
+type replicaHash struct {
+	Hash      uint64 `json:"hash"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// loadAlarms reads any alarms left over from a previous process (persisted
+// under /pcs/alarms/*) back into e.alarms, so a restart after a corrupt
+// alarm was raised doesn't silently drop back into read-write mode. Init
+// calls this once the KV handle is open.
+func (e *ETCDStorage) loadAlarms() error {
+	k := e.fixUpKey(keySegAlarms)
+	kvl, err := e.kvHandle.GetRange(k+keyMin, k+keyMax)
+	if err != nil {
+		return err
+	}
+
+	e.alarmMutex.Lock()
+	defer e.alarmMutex.Unlock()
+	if e.alarms == nil {
+		e.alarms = make(map[string]bool)
+	}
+	prefix := k + "/"
+	for _, kv := range kvl {
+		if !strings.HasPrefix(kv.Key, prefix) {
+			continue
+		}
+		kind := strings.TrimPrefix(kv.Key, prefix)
+		e.alarms[kind] = true
+		e.Logger.Warn("integrity check: restored alarm '", kind, "' from storage, starting in read-only mode")
+	}
+	return nil
+}
+
+func (e *ETCDStorage) instanceID() string {
+	if e.instID == "" {
+		e.instID = uuid.New().String()
+	}
+	return e.instID
+}
+
+func corruptCheckInterval() time.Duration {
+	if v, ok := os.LookupEnv("PCS_CORRUPT_CHECK_INTERVAL"); ok {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			return d
+		}
+	}
+	return corruptCheckIntervalDefault
+}
+
+// StartIntegrityChecker launches the periodic corruption check in the
+// background. Calling it twice on the same ETCDStorage is a no-op.
+func (e *ETCDStorage) StartIntegrityChecker() {
+	if e.stopIntegrity != nil {
+		return
+	}
+	e.stopIntegrity = make(chan struct{})
+	go e.runIntegrityCheckLoop(e.stopIntegrity)
+}
+
+// StopIntegrityChecker stops a previously-started integrity checker.
+func (e *ETCDStorage) StopIntegrityChecker() {
+	if e.stopIntegrity == nil {
+		return
+	}
+	close(e.stopIntegrity)
+	e.stopIntegrity = nil
+}
+
+func (e *ETCDStorage) runIntegrityCheckLoop(stop chan struct{}) {
+	ticker := time.NewTicker(corruptCheckInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := e.checkIntegrityOnce(); err != nil {
+				e.Logger.Error(err)
+			}
+		}
+	}
+}
+
+// checkIntegrityOnce computes this replica's hash of the powerstate
+// keyspace, publishes it, and -- if this replica is the elected comparer --
+// reads every published replica hash and raises the corrupt alarm on any
+// mismatch.
+func (e *ETCDStorage) checkIntegrityOnce() error {
+	hash, err := e.computeClusterHash()
+	if err != nil {
+		return err
+	}
+
+	selfKey := fmt.Sprintf("%s/%s", keySegIntegrity, e.instanceID())
+	if err := e.kvStore(selfKey, replicaHash{Hash: hash, Timestamp: time.Now().Unix()}); err != nil {
+		return err
+	}
+
+	fresh, err := e.freshReplicaHashes()
+	if err != nil {
+		return err
+	}
+
+	if !e.isElectedComparer(fresh) {
+		return nil
+	}
+
+	seen := make(map[uint64]bool)
+	for _, rh := range fresh {
+		seen[rh.Hash] = true
+	}
+	if len(seen) > 1 {
+		e.raiseAlarm("corrupt")
+	}
+	return nil
+}
+
+// freshReplicaHashes reads every published replica hash, decompresses and
+// parses it, and returns only the ones published within the staleness
+// window. Entries published by a replica that has since crashed or been
+// removed are pruned here so they never again count toward a mismatch or
+// toward leader election.
+//
+// A replica hash record that fails to decompress or unmarshal is not a
+// stale/crashed replica -- it's direct evidence that the record itself is
+// corrupt -- so it raises the corrupt alarm (in addition to being skipped
+// for this round's comparison) rather than being silently logged and
+// ignored.
+func (e *ETCDStorage) freshReplicaHashes() (map[string]replicaHash, error) {
+	k := e.fixUpKey(keySegIntegrity)
+	kvl, err := e.kvHandle.GetRange(k+keyMin, k+keyMax)
+	if err != nil {
+		return nil, err
+	}
+
+	staleBefore := time.Now().Add(-staleReplicaIntervals * corruptCheckInterval()).Unix()
+	fresh := make(map[string]replicaHash, len(kvl))
+	for _, kv := range kvl {
+		raw, derr := decompressEnvelope([]byte(kv.Value))
+		if derr != nil {
+			e.Logger.Error("integrity check: replica hash record '", kv.Key, "' failed to decompress: ", derr)
+			e.raiseAlarm("corrupt")
+			continue
+		}
+		var rh replicaHash
+		if jerr := json.Unmarshal(raw, &rh); jerr != nil {
+			e.Logger.Error("integrity check: replica hash record '", kv.Key, "' failed to parse: ", jerr)
+			e.raiseAlarm("corrupt")
+			continue
+		}
+		if rh.Timestamp < staleBefore {
+			if err := e.kvDelete(kv.Key); err != nil {
+				e.Logger.Error(err)
+			}
+			continue
+		}
+		fresh[kv.Key] = rh
+	}
+	return fresh, nil
+}
+
+// isElectedComparer reports whether this replica is responsible for
+// comparing hashes this round: the replica whose instance ID sorts first
+// among those with a fresh (non-stale) published hash.
+//
+// This is NOT a lease-based election -- there is no ownership record or
+// fencing token, just each replica independently sorting its own view of
+// freshReplicaHashes. Two replicas can therefore transiently both believe
+// they're the comparer if their views of "fresh" diverge by a beat (e.g.
+// one has already pruned a stale entry the other hasn't gotten to yet).
+// That's tolerated rather than fixed here: raiseAlarm is idempotent, so a
+// duplicate comparison just raises (or confirms) the same alarm twice
+// instead of causing incorrect behavior. A real lease would need an actual
+// ETCD lease grant/keep-alive, which hmetcd.Kvi doesn't expose.
+func (e *ETCDStorage) isElectedComparer(fresh map[string]replicaHash) bool {
+	if len(fresh) == 0 {
+		return true
+	}
+	ids := make([]string, 0, len(fresh))
+	for key := range fresh {
+		ids = append(ids, key)
+	}
+	sort.Strings(ids)
+	return ids[0] == e.fixUpKey(fmt.Sprintf("%s/%s", keySegIntegrity, e.instanceID()))
+}
+
+// computeClusterHash recomputes an FNV-64 hash over every sorted
+// key+value pair under /pcs/powerstate/*. Values are decompressed to their
+// canonical form before hashing so the result only reflects the stored
+// PowerStatusComponent data, not each replica's PCS_KV_COMPRESS_ALGO
+// setting -- otherwise replicas holding identical data but different
+// compression config would disagree and trip the corruption alarm.
+//
+// A value that fails to decompress is itself the clearest local corruption
+// signal this subsystem can see, so it raises the corrupt alarm directly
+// here rather than letting the error bubble up as a generic failure that
+// checkIntegrityOnce would just log and move on from.
+func (e *ETCDStorage) computeClusterHash() (uint64, error) {
+	k := e.fixUpKey(keySegPowerState)
+	kvl, err := e.kvHandle.GetRange(k+keyMin, k+keyMax)
+	if err != nil {
+		return 0, err
+	}
+	sort.Slice(kvl, func(i, j int) bool { return kvl[i].Key < kvl[j].Key })
+
+	h := fnv.New64()
+	for _, kv := range kvl {
+		raw, derr := decompressEnvelope([]byte(kv.Value))
+		if derr != nil {
+			e.Logger.Error("integrity check: stored value for '", kv.Key, "' failed to decompress: ", derr)
+			e.raiseAlarm("corrupt")
+			return 0, derr
+		}
+		h.Write([]byte(kv.Key))
+		h.Write(raw)
+	}
+	return h.Sum64(), nil
+}
+
+// raiseAlarm records a persistent alarm of the given kind and flips this
+// ETCDStorage into read-only mode.
+func (e *ETCDStorage) raiseAlarm(kind string) {
+	e.alarmMutex.Lock()
+	defer e.alarmMutex.Unlock()
+	if e.alarms == nil {
+		e.alarms = make(map[string]bool)
+	}
+	if !e.alarms[kind] {
+		e.Logger.Error("integrity check: raising alarm '", kind, "', switching to read-only")
+	}
+	e.alarms[kind] = true
+	e.kvStore(fmt.Sprintf("%s/%s", keySegAlarms, kind), true)
+}
+
+// DisarmAlarm clears a previously-raised alarm of the given kind. Writes
+// resume once every alarm has been cleared.
+func (e *ETCDStorage) DisarmAlarm(kind string) error {
+	e.alarmMutex.Lock()
+	defer e.alarmMutex.Unlock()
+	delete(e.alarms, kind)
+	return e.kvDelete(fmt.Sprintf("%s/%s", keySegAlarms, kind))
+}
+
+// GetAlarms returns the set of currently-raised alarm kinds.
+func (e *ETCDStorage) GetAlarms() []string {
+	e.alarmMutex.Lock()
+	defer e.alarmMutex.Unlock()
+	alarms := make([]string, 0, len(e.alarms))
+	for kind := range e.alarms {
+		alarms = append(alarms, kind)
+	}
+	sort.Strings(alarms)
+	return alarms
+}
+
+func (e *ETCDStorage) isReadOnly() bool {
+	e.alarmMutex.Lock()
+	defer e.alarmMutex.Unlock()
+	return len(e.alarms) > 0
+}
@@ -0,0 +1,332 @@
+// MIT License
+//
+// (C) Copyright [2022] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package storage
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func newTestIntegrityBackend(t *testing.T) *ETCDStorage {
+	t.Helper()
+	b := &ETCDStorage{memOnly: true}
+	if err := b.Init(logrus.New()); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	return b
+}
+
+// TestComputeClusterHashIndependentOfCompression ensures two replicas
+// holding byte-identical PowerStatusComponent data hash the same even when
+// their PCS_KV_COMPRESS_ALGO settings differ, so a compression config drift
+// alone can never trip the corruption alarm.
+func TestComputeClusterHashIndependentOfCompression(t *testing.T) {
+	origAlgo, hadAlgo := os.LookupEnv("PCS_KV_COMPRESS_ALGO")
+	origMin, hadMin := os.LookupEnv("PCS_KV_COMPRESS_MIN_BYTES")
+	defer func() {
+		if hadAlgo {
+			os.Setenv("PCS_KV_COMPRESS_ALGO", origAlgo)
+		} else {
+			os.Unsetenv("PCS_KV_COMPRESS_ALGO")
+		}
+		if hadMin {
+			os.Setenv("PCS_KV_COMPRESS_MIN_BYTES", origMin)
+		} else {
+			os.Unsetenv("PCS_KV_COMPRESS_MIN_BYTES")
+		}
+	}()
+
+	// Force every value, however small, through the compression envelope
+	// so the "none" vs "gzip" replicas below actually diverge in their raw
+	// stored bytes.
+	os.Setenv("PCS_KV_COMPRESS_MIN_BYTES", "0")
+
+	want := PowerStatusComponent{XName: "x0c0s0b0n0"}
+
+	os.Setenv("PCS_KV_COMPRESS_ALGO", "none")
+	uncompressed := &ETCDStorage{memOnly: true}
+	if err := uncompressed.Init(logrus.New()); err != nil {
+		t.Fatalf("Init (uncompressed): %v", err)
+	}
+	if err := uncompressed.StorePowerStatus(want); err != nil {
+		t.Fatalf("StorePowerStatus (uncompressed): %v", err)
+	}
+	uncompressedHash, err := uncompressed.computeClusterHash()
+	if err != nil {
+		t.Fatalf("computeClusterHash (uncompressed): %v", err)
+	}
+
+	os.Setenv("PCS_KV_COMPRESS_ALGO", "gzip")
+	compressed := &ETCDStorage{memOnly: true}
+	if err := compressed.Init(logrus.New()); err != nil {
+		t.Fatalf("Init (compressed): %v", err)
+	}
+	if err := compressed.StorePowerStatus(want); err != nil {
+		t.Fatalf("StorePowerStatus (compressed): %v", err)
+	}
+	compressedHash, err := compressed.computeClusterHash()
+	if err != nil {
+		t.Fatalf("computeClusterHash (compressed): %v", err)
+	}
+
+	if uncompressedHash != compressedHash {
+		t.Errorf("computeClusterHash differed across compression settings for identical data: %d (none) vs %d (gzip)", uncompressedHash, compressedHash)
+	}
+}
+
+// TestLoadAlarmsRestoresPersistedAlarm ensures an alarm raised by a previous
+// process is restored into memory (and read-only mode re-engaged) the next
+// time loadAlarms runs, instead of quietly dropping back into read-write
+// mode after a restart.
+func TestLoadAlarmsRestoresPersistedAlarm(t *testing.T) {
+	b := newTestIntegrityBackend(t)
+	b.raiseAlarm("corrupt")
+	if !b.isReadOnly() {
+		t.Fatalf("raiseAlarm: isReadOnly() false immediately after raising an alarm")
+	}
+
+	// Simulate a restart: the persisted alarm record is still in the KV
+	// store, but in-memory state is gone.
+	b.alarmMutex.Lock()
+	b.alarms = nil
+	b.alarmMutex.Unlock()
+	if b.isReadOnly() {
+		t.Fatalf("test setup: isReadOnly() true after clearing in-memory alarms")
+	}
+
+	if err := b.loadAlarms(); err != nil {
+		t.Fatalf("loadAlarms: %v", err)
+	}
+	if !b.isReadOnly() {
+		t.Errorf("loadAlarms: isReadOnly() false after reloading a persisted alarm")
+	}
+	found := false
+	for _, kind := range b.GetAlarms() {
+		if kind == "corrupt" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("GetAlarms: %v does not contain the restored 'corrupt' alarm", b.GetAlarms())
+	}
+}
+
+// TestDisarmAlarmClearsReadOnly verifies that disarming the only outstanding
+// alarm returns storage to read-write mode.
+func TestDisarmAlarmClearsReadOnly(t *testing.T) {
+	b := newTestIntegrityBackend(t)
+	b.raiseAlarm("corrupt")
+	if !b.isReadOnly() {
+		t.Fatalf("raiseAlarm: isReadOnly() false after raising an alarm")
+	}
+	if err := b.DisarmAlarm("corrupt"); err != nil {
+		t.Fatalf("DisarmAlarm: %v", err)
+	}
+	if b.isReadOnly() {
+		t.Errorf("DisarmAlarm: isReadOnly() still true after disarming the only outstanding alarm")
+	}
+}
+
+// TestFreshReplicaHashesPrunesStale ensures a replica hash published outside
+// the staleness window is treated as a crashed/partitioned replica: it's
+// excluded from the result and deleted, rather than counted toward a
+// mismatch or toward leader election.
+func TestFreshReplicaHashesPrunesStale(t *testing.T) {
+	os.Setenv("PCS_CORRUPT_CHECK_INTERVAL", "1s")
+	defer os.Unsetenv("PCS_CORRUPT_CHECK_INTERVAL")
+
+	b := newTestIntegrityBackend(t)
+
+	freshKey := fmt.Sprintf("%s/fresh-replica", keySegIntegrity)
+	if err := b.kvStore(freshKey, replicaHash{Hash: 1, Timestamp: time.Now().Unix()}); err != nil {
+		t.Fatalf("kvStore (fresh): %v", err)
+	}
+	staleKey := fmt.Sprintf("%s/stale-replica", keySegIntegrity)
+	staleTS := time.Now().Add(-10 * staleReplicaIntervals * time.Second).Unix()
+	if err := b.kvStore(staleKey, replicaHash{Hash: 2, Timestamp: staleTS}); err != nil {
+		t.Fatalf("kvStore (stale): %v", err)
+	}
+
+	fresh, err := b.freshReplicaHashes()
+	if err != nil {
+		t.Fatalf("freshReplicaHashes: %v", err)
+	}
+
+	fullFreshKey := b.fixUpKey(freshKey)
+	fullStaleKey := b.fixUpKey(staleKey)
+	if _, ok := fresh[fullFreshKey]; !ok {
+		t.Errorf("freshReplicaHashes: fresh replica entry missing from result")
+	}
+	if _, ok := fresh[fullStaleKey]; ok {
+		t.Errorf("freshReplicaHashes: stale replica entry should have been pruned from the result")
+	}
+
+	k := b.fixUpKey(keySegIntegrity)
+	kvl, err := b.kvHandle.GetRange(k+keyMin, k+keyMax)
+	if err != nil {
+		t.Fatalf("GetRange: %v", err)
+	}
+	for _, kv := range kvl {
+		if kv.Key == fullStaleKey {
+			t.Errorf("freshReplicaHashes: stale replica key %q was not deleted from storage", fullStaleKey)
+		}
+	}
+}
+
+// TestIsElectedComparerLowestIDWins ensures leader election picks the
+// replica whose instance key sorts first, deterministically, rather than
+// every fresh replica redundantly comparing and alarming.
+func TestIsElectedComparerLowestIDWins(t *testing.T) {
+	b := newTestIntegrityBackend(t)
+	b.instID = "0000"
+
+	selfKey := b.fixUpKey(fmt.Sprintf("%s/%s", keySegIntegrity, b.instanceID()))
+	higherKey := b.fixUpKey(fmt.Sprintf("%s/zzzz", keySegIntegrity))
+
+	fresh := map[string]replicaHash{
+		selfKey:   {Hash: 1, Timestamp: time.Now().Unix()},
+		higherKey: {Hash: 1, Timestamp: time.Now().Unix()},
+	}
+	if !b.isElectedComparer(fresh) {
+		t.Errorf("isElectedComparer: false for the lowest-sorting instance key")
+	}
+
+	b2 := newTestIntegrityBackend(t)
+	b2.instID = "zzzz"
+	if b2.isElectedComparer(fresh) {
+		t.Errorf("isElectedComparer: true for a higher-sorting instance key")
+	}
+}
+
+// TestIsElectedComparerNoFreshReplicas ensures a replica with no other
+// fresh replicas to compare against still elects itself, so integrity
+// checking works for a single-replica deployment too.
+func TestIsElectedComparerNoFreshReplicas(t *testing.T) {
+	b := newTestIntegrityBackend(t)
+	if !b.isElectedComparer(map[string]replicaHash{}) {
+		t.Errorf("isElectedComparer: false with no other fresh replicas")
+	}
+}
+
+// TestCheckIntegrityOnceRaisesAlarmOnMismatch simulates a second replica
+// reporting a different hash than this replica's own computed hash, and
+// verifies the elected comparer raises the corrupt alarm.
+func TestCheckIntegrityOnceRaisesAlarmOnMismatch(t *testing.T) {
+	b := newTestIntegrityBackend(t)
+	// A short, empty-prefix instance ID guarantees this replica's own key
+	// sorts first among any plausible fake peer key below, so it's always
+	// the elected comparer.
+	b.instID = "0000"
+
+	ownHash, err := b.computeClusterHash()
+	if err != nil {
+		t.Fatalf("computeClusterHash: %v", err)
+	}
+	peerKey := fmt.Sprintf("%s/peer-replica", keySegIntegrity)
+	if err := b.kvStore(peerKey, replicaHash{Hash: ownHash + 1, Timestamp: time.Now().Unix()}); err != nil {
+		t.Fatalf("kvStore: %v", err)
+	}
+
+	if err := b.checkIntegrityOnce(); err != nil {
+		t.Fatalf("checkIntegrityOnce: %v", err)
+	}
+	if !b.isReadOnly() {
+		t.Errorf("checkIntegrityOnce: expected the corrupt alarm to be raised on a hash mismatch")
+	}
+}
+
+// malformedCompressEnvelope is a syntactically valid kvCompressEnvelope
+// whose payload is not actually a valid gzip stream, so decompressEnvelope
+// fails on it -- simulating a value corrupted on disk rather than one that
+// simply predates compression being enabled.
+const malformedCompressEnvelope = `{"c":"gzip","v":"bm90Z3ppcA=="}`
+
+// TestComputeClusterHashRaisesAlarmOnDecompressFailure ensures a stored
+// powerstate value that fails to decompress is treated as direct evidence
+// of corruption -- raising the alarm -- rather than silently failing
+// checkIntegrityOnce with no alarm raised.
+func TestComputeClusterHashRaisesAlarmOnDecompressFailure(t *testing.T) {
+	b := newTestIntegrityBackend(t)
+	fullKey := b.fixUpKey(fmt.Sprintf("%s/%s", keySegPowerState, "x0c0s0b0nbad"))
+	if err := b.kvHandle.Store(fullKey, malformedCompressEnvelope); err != nil {
+		t.Fatalf("kvHandle.Store: %v", err)
+	}
+
+	if _, err := b.computeClusterHash(); err == nil {
+		t.Fatalf("computeClusterHash: expected an error for an undecompressable value, got nil")
+	}
+	if !b.isReadOnly() {
+		t.Errorf("computeClusterHash: expected the corrupt alarm to be raised on a decompress failure")
+	}
+}
+
+// TestFreshReplicaHashesRaisesAlarmOnDecompressFailure is the
+// freshReplicaHashes analog of TestComputeClusterHashRaisesAlarmOnDecompressFailure:
+// a replica hash record that fails to decompress is corruption evidence in
+// its own right, not just a replica to silently skip.
+func TestFreshReplicaHashesRaisesAlarmOnDecompressFailure(t *testing.T) {
+	b := newTestIntegrityBackend(t)
+	fullKey := b.fixUpKey(fmt.Sprintf("%s/bad-replica", keySegIntegrity))
+	if err := b.kvHandle.Store(fullKey, malformedCompressEnvelope); err != nil {
+		t.Fatalf("kvHandle.Store: %v", err)
+	}
+
+	fresh, err := b.freshReplicaHashes()
+	if err != nil {
+		t.Fatalf("freshReplicaHashes: %v", err)
+	}
+	if _, ok := fresh[fullKey]; ok {
+		t.Errorf("freshReplicaHashes: undecompressable entry should not appear in the result")
+	}
+	if !b.isReadOnly() {
+		t.Errorf("freshReplicaHashes: expected the corrupt alarm to be raised on a decompress failure")
+	}
+}
+
+// TestCheckIntegrityOnceNoAlarmOnAgreement is the converse of
+// TestCheckIntegrityOnceRaisesAlarmOnMismatch: when every fresh replica
+// reports the same hash, no alarm should be raised.
+func TestCheckIntegrityOnceNoAlarmOnAgreement(t *testing.T) {
+	b := newTestIntegrityBackend(t)
+	b.instID = "0000"
+
+	ownHash, err := b.computeClusterHash()
+	if err != nil {
+		t.Fatalf("computeClusterHash: %v", err)
+	}
+	peerKey := fmt.Sprintf("%s/peer-replica", keySegIntegrity)
+	if err := b.kvStore(peerKey, replicaHash{Hash: ownHash, Timestamp: time.Now().Unix()}); err != nil {
+		t.Fatalf("kvStore: %v", err)
+	}
+
+	if err := b.checkIntegrityOnce(); err != nil {
+		t.Fatalf("checkIntegrityOnce: %v", err)
+	}
+	if b.isReadOnly() {
+		t.Errorf("checkIntegrityOnce: alarm raised even though every fresh replica hash agreed")
+	}
+}
@@ -0,0 +1,245 @@
+// MIT License
+//
+// (C) Copyright [2022] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package storage
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// This file adds lease/TTL support so a PowerStatusComponent written with
+// StorePowerStatusWithTTL self-deletes once its TTL elapses, instead of
+// lingering under /pcs/powerstate/* after HSM removes the component or a
+// BMC goes permanently unreachable.
+//
+// hmetcd.Kvi (used elsewhere in this package for Store/Get/Delete/GetRange)
+// doesn't expose an ETCD lease grant/keep-alive/revoke primitive, so leases
+// are emulated here with per-bucket timers instead: every distinct TTL
+// rounded to the nearest second gets one shared bucket and one ticker, and
+// that ticker sweeps every key registered in the bucket rather than each
+// key owning its own timer. This gives the same "one lease per TTL class,
+// not one per key" behavior the real ETCD lease API has, and it works
+// identically against the in-memory hmetcd backend used in tests.
+
+var (
+	kvLeaseGrants = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "pcs_kv_lease_grants_total",
+		Help: "Total number of power-status TTL leases granted or refreshed.",
+	})
+	kvLeaseRevokes = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "pcs_kv_lease_revokes_total",
+		Help: "Total number of power-status TTL leases that expired and deleted their key.",
+	})
+)
+
+type leaseEntry struct {
+	expiresAt time.Time
+}
+
+type leaseBucket struct {
+	ttl     time.Duration
+	mutex   sync.Mutex
+	entries map[string]*leaseEntry
+	stop    chan struct{}
+}
+
+// leasePool is the per-ETCDStorage set of TTL buckets, lazily created.
+type leasePool struct {
+	mutex   sync.Mutex
+	buckets map[time.Duration]*leaseBucket
+}
+
+func bucketTTL(ttl time.Duration) time.Duration {
+	rounded := ttl.Round(time.Second)
+	if rounded <= 0 {
+		rounded = time.Second
+	}
+	return rounded
+}
+
+// bucketFor returns the shared bucket for ttl, creating it if needed. The
+// buckets map itself is always guarded by pool.mutex -- the same lock
+// RefreshPowerStatus and StopLeases take -- so e.leaseMutex is only ever
+// used to lazily create the *leasePool pointer itself.
+func (e *ETCDStorage) bucketFor(ttl time.Duration) *leaseBucket {
+	e.leaseMutex.Lock()
+	if e.leases == nil {
+		e.leases = &leasePool{buckets: make(map[time.Duration]*leaseBucket)}
+	}
+	pool := e.leases
+	e.leaseMutex.Unlock()
+
+	key := bucketTTL(ttl)
+
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	b, ok := pool.buckets[key]
+	if ok {
+		return b
+	}
+
+	b = &leaseBucket{
+		ttl:     key,
+		entries: make(map[string]*leaseEntry),
+		stop:    make(chan struct{}),
+	}
+	pool.buckets[key] = b
+	go e.runLeaseBucket(b)
+	return b
+}
+
+// clearLease removes xname's entry from every TTL bucket, if it has one.
+// StorePowerStatus calls this on every write (TTL or not) so that a key
+// moving to a new TTL bucket, or being re-stored without a TTL at all,
+// never leaves a stale leaseEntry behind in its old bucket -- otherwise
+// that bucket's sweep would later delete the just-(re)written value out
+// from under the caller, even though it was never asked to expire.
+func (e *ETCDStorage) clearLease(xname string) {
+	e.leaseMutex.Lock()
+	pool := e.leases
+	e.leaseMutex.Unlock()
+	if pool == nil {
+		return
+	}
+
+	pool.mutex.Lock()
+	buckets := make([]*leaseBucket, 0, len(pool.buckets))
+	for _, b := range pool.buckets {
+		buckets = append(buckets, b)
+	}
+	pool.mutex.Unlock()
+
+	for _, b := range buckets {
+		b.mutex.Lock()
+		delete(b.entries, xname)
+		b.mutex.Unlock()
+	}
+}
+
+// StopLeases stops every TTL bucket's sweep goroutine. It does not delete
+// any keys that already have an outstanding lease; it only tears down the
+// background expiry machinery, e.g. as part of process shutdown.
+func (e *ETCDStorage) StopLeases() {
+	e.leaseMutex.Lock()
+	pool := e.leases
+	e.leaseMutex.Unlock()
+	if pool == nil {
+		return
+	}
+
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	for ttl, b := range pool.buckets {
+		close(b.stop)
+		delete(pool.buckets, ttl)
+	}
+}
+
+func (e *ETCDStorage) runLeaseBucket(b *leaseBucket) {
+	// Sweep at a tenth of the bucket's TTL (floor one second) so expiry is
+	// reasonably timely without a ticker per key.
+	interval := b.ttl / 10
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.stop:
+			return
+		case now := <-ticker.C:
+			var expired []string
+			b.mutex.Lock()
+			for xname, entry := range b.entries {
+				if !now.Before(entry.expiresAt) {
+					expired = append(expired, xname)
+					delete(b.entries, xname)
+				}
+			}
+			b.mutex.Unlock()
+
+			for _, xname := range expired {
+				if err := e.DeletePowerStatus(xname); err != nil {
+					e.Logger.Error(err)
+				} else {
+					kvLeaseRevokes.Inc()
+				}
+			}
+		}
+	}
+}
+
+// StorePowerStatusWithTTL stores p exactly as StorePowerStatus does, and
+// additionally attaches a lease so the key is automatically removed after
+// ttl unless RefreshPowerStatus is called again before then.
+func (e *ETCDStorage) StorePowerStatusWithTTL(p PowerStatusComponent, ttl time.Duration) error {
+	if err := e.StorePowerStatus(p); err != nil {
+		return err
+	}
+
+	b := e.bucketFor(ttl)
+	b.mutex.Lock()
+	b.entries[p.XName] = &leaseEntry{expiresAt: time.Now().Add(b.ttl)}
+	b.mutex.Unlock()
+	kvLeaseGrants.Inc()
+	return nil
+}
+
+// RefreshPowerStatus keep-alives xname's lease, pushing its expiry back out
+// to the full TTL it was granted with. It returns an error if xname has no
+// active lease (it was never stored with a TTL, or has already expired).
+func (e *ETCDStorage) RefreshPowerStatus(xname string) error {
+	e.leaseMutex.Lock()
+	pool := e.leases
+	e.leaseMutex.Unlock()
+	if pool == nil {
+		return fmt.Errorf("RefreshPowerStatus: no active lease for '%s'", xname)
+	}
+
+	pool.mutex.Lock()
+	buckets := make([]*leaseBucket, 0, len(pool.buckets))
+	for _, b := range pool.buckets {
+		buckets = append(buckets, b)
+	}
+	pool.mutex.Unlock()
+
+	for _, b := range buckets {
+		b.mutex.Lock()
+		entry, ok := b.entries[xname]
+		if ok {
+			entry.expiresAt = time.Now().Add(b.ttl)
+		}
+		b.mutex.Unlock()
+		if ok {
+			kvLeaseGrants.Inc()
+			return nil
+		}
+	}
+	return fmt.Errorf("RefreshPowerStatus: no active lease for '%s'", xname)
+}
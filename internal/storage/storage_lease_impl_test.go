@@ -0,0 +1,161 @@
+// MIT License
+//
+// (C) Copyright [2022] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func newTestLeaseBackend(t *testing.T) *ETCDStorage {
+	t.Helper()
+	b := &ETCDStorage{memOnly: true}
+	if err := b.Init(logrus.New()); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	return b
+}
+
+func TestStorePowerStatusWithTTLExpires(t *testing.T) {
+	b := newTestLeaseBackend(t)
+	defer b.StopLeases()
+
+	xname := "x0c0s0b0n0"
+	if err := b.StorePowerStatusWithTTL(PowerStatusComponent{XName: xname}, time.Second); err != nil {
+		t.Fatalf("StorePowerStatusWithTTL: %v", err)
+	}
+
+	if _, err := b.GetPowerStatus(xname); err != nil {
+		t.Fatalf("GetPowerStatus immediately after store: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, err := b.GetPowerStatus(xname); err != nil {
+			return
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	t.Fatalf("GetPowerStatus: %q was not expired within the deadline", xname)
+}
+
+func TestRefreshPowerStatusExtendsLease(t *testing.T) {
+	b := newTestLeaseBackend(t)
+	defer b.StopLeases()
+
+	xname := "x0c0s0b0n1"
+	if err := b.StorePowerStatusWithTTL(PowerStatusComponent{XName: xname}, time.Second); err != nil {
+		t.Fatalf("StorePowerStatusWithTTL: %v", err)
+	}
+
+	// Keep refreshing the lease faster than it could expire; the key
+	// should survive well past the original TTL.
+	stop := time.After(2500 * time.Millisecond)
+	ticker := time.NewTicker(300 * time.Millisecond)
+	defer ticker.Stop()
+refreshLoop:
+	for {
+		select {
+		case <-ticker.C:
+			if err := b.RefreshPowerStatus(xname); err != nil {
+				t.Fatalf("RefreshPowerStatus: %v", err)
+			}
+		case <-stop:
+			break refreshLoop
+		}
+	}
+
+	if _, err := b.GetPowerStatus(xname); err != nil {
+		t.Fatalf("GetPowerStatus: %q expired despite being refreshed: %v", xname, err)
+	}
+}
+
+func TestRefreshPowerStatusNoLease(t *testing.T) {
+	b := newTestLeaseBackend(t)
+	defer b.StopLeases()
+
+	if err := b.RefreshPowerStatus("x0c0s0b0n2"); err == nil {
+		t.Errorf("RefreshPowerStatus: expected an error for an xname with no lease, got nil")
+	}
+}
+
+// TestStorePowerStatusWithTTLRebucketDropsStaleLease guards against the old
+// TTL bucket's sweep deleting data that was explicitly re-stored under a
+// longer TTL before the original one elapsed.
+func TestStorePowerStatusWithTTLRebucketDropsStaleLease(t *testing.T) {
+	b := newTestLeaseBackend(t)
+	defer b.StopLeases()
+
+	xname := "x0c0s0b0n4"
+	if err := b.StorePowerStatusWithTTL(PowerStatusComponent{XName: xname}, time.Second); err != nil {
+		t.Fatalf("StorePowerStatusWithTTL (1s): %v", err)
+	}
+	if err := b.StorePowerStatusWithTTL(PowerStatusComponent{XName: xname}, 5*time.Second); err != nil {
+		t.Fatalf("StorePowerStatusWithTTL (5s): %v", err)
+	}
+
+	// Wait past the original 1s TTL. If the stale leaseEntry in the old
+	// bucket wasn't cleared, its sweep deletes the key right about now.
+	time.Sleep(2 * time.Second)
+	if _, err := b.GetPowerStatus(xname); err != nil {
+		t.Fatalf("GetPowerStatus: %q was deleted by its old bucket after being re-stored with a longer TTL: %v", xname, err)
+	}
+}
+
+// TestStorePowerStatusClearsLease ensures a plain StorePowerStatus call
+// (no TTL) after an earlier TTL write makes the value permanent, instead
+// of leaving the old lease in place to delete it out from under the caller.
+func TestStorePowerStatusClearsLease(t *testing.T) {
+	b := newTestLeaseBackend(t)
+	defer b.StopLeases()
+
+	xname := "x0c0s0b0n5"
+	if err := b.StorePowerStatusWithTTL(PowerStatusComponent{XName: xname}, time.Second); err != nil {
+		t.Fatalf("StorePowerStatusWithTTL: %v", err)
+	}
+	if err := b.StorePowerStatus(PowerStatusComponent{XName: xname}); err != nil {
+		t.Fatalf("StorePowerStatus: %v", err)
+	}
+
+	time.Sleep(2 * time.Second)
+	if _, err := b.GetPowerStatus(xname); err != nil {
+		t.Fatalf("GetPowerStatus: %q was deleted by its old TTL lease despite being re-stored with plain StorePowerStatus: %v", xname, err)
+	}
+}
+
+func TestStopLeasesHaltsExpiry(t *testing.T) {
+	b := newTestLeaseBackend(t)
+
+	xname := "x0c0s0b0n3"
+	if err := b.StorePowerStatusWithTTL(PowerStatusComponent{XName: xname}, time.Second); err != nil {
+		t.Fatalf("StorePowerStatusWithTTL: %v", err)
+	}
+	b.StopLeases()
+
+	time.Sleep(3 * time.Second)
+	if _, err := b.GetPowerStatus(xname); err != nil {
+		t.Fatalf("GetPowerStatus: %q was expired even though StopLeases had already halted the sweep: %v", xname, err)
+	}
+}
@@ -0,0 +1,190 @@
+// MIT License
+//
+// (C) Copyright [2022] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/Cray-HPE/hms-xname/xnametypes"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/sirupsen/logrus"
+)
+
+// PostgresStorage is a Backend driver backed by a Postgres "power_status"
+// table keyed on xname, selected via PCS_STORAGE_BACKEND=postgres. It mirrors
+// the field names ETCDStorage uses so the two drivers are easy to compare.
+type PostgresStorage struct {
+	Logger *logrus.Logger
+	pool   *pgxpool.Pool
+}
+
+const postgresSchema = `
+CREATE TABLE IF NOT EXISTS power_status (
+	xname TEXT PRIMARY KEY,
+	data  JSONB NOT NULL
+);
+`
+
+func (p *PostgresStorage) Init(Logger *logrus.Logger) error {
+	if Logger == nil {
+		p.Logger = logrus.New()
+	} else {
+		p.Logger = Logger
+	}
+
+	dsn, ok := os.LookupEnv("PCS_POSTGRES_DSN")
+	if !ok {
+		return fmt.Errorf("No PCS_POSTGRES_DSN specified, can't open Postgres.")
+	}
+
+	pool, err := pgxpool.Connect(context.Background(), dsn)
+	if err != nil {
+		return fmt.Errorf("connecting to postgres: %v", err)
+	}
+	p.pool = pool
+
+	if _, err := p.pool.Exec(context.Background(), postgresSchema); err != nil {
+		return fmt.Errorf("creating power_status table: %v", err)
+	}
+	return nil
+}
+
+func (p *PostgresStorage) Ping() error {
+	return p.pool.Ping(context.Background())
+}
+
+func (p *PostgresStorage) StorePowerStatus(pcomp PowerStatusComponent) error {
+	if !(xnametypes.IsHMSCompIDValid(pcomp.XName)) {
+		return fmt.Errorf("Error parsing '%s': invalid xname format.", pcomp.XName)
+	}
+	data, err := json.Marshal(pcomp)
+	if err != nil {
+		return err
+	}
+	_, err = p.pool.Exec(context.Background(),
+		`INSERT INTO power_status (xname, data) VALUES ($1, $2)
+		 ON CONFLICT (xname) DO UPDATE SET data = EXCLUDED.data`,
+		pcomp.XName, data)
+	if err != nil {
+		p.Logger.Error(err)
+	} else {
+		p.pool.Exec(context.Background(), `SELECT pg_notify('power_status_changes', $1)`, pcomp.XName)
+	}
+	return err
+}
+
+func (p *PostgresStorage) DeletePowerStatus(xname string) error {
+	if !(xnametypes.IsHMSCompIDValid(xname)) {
+		return fmt.Errorf("Error parsing '%s': invalid xname format.", xname)
+	}
+	_, err := p.pool.Exec(context.Background(), `DELETE FROM power_status WHERE xname = $1`, xname)
+	if err != nil {
+		p.Logger.Error(err)
+	} else {
+		p.pool.Exec(context.Background(), `SELECT pg_notify('power_status_changes', $1)`, xname)
+	}
+	return err
+}
+
+func (p *PostgresStorage) GetPowerStatus(xname string) (PowerStatusComponent, error) {
+	var pcomp PowerStatusComponent
+	if !(xnametypes.IsHMSCompIDValid(xname)) {
+		return pcomp, fmt.Errorf("Error parsing '%s': invalid xname format.", xname)
+	}
+	var data []byte
+	err := p.pool.QueryRow(context.Background(),
+		`SELECT data FROM power_status WHERE xname = $1`, xname).Scan(&data)
+	if err != nil {
+		p.Logger.Error(err)
+		return pcomp, err
+	}
+	err = json.Unmarshal(data, &pcomp)
+	return pcomp, err
+}
+
+func (p *PostgresStorage) GetAllPowerStatus() (PowerStatus, error) {
+	var pstats PowerStatus
+	rows, err := p.pool.Query(context.Background(), `SELECT data FROM power_status`)
+	if err != nil {
+		p.Logger.Error(err)
+		return pstats, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			p.Logger.Error(err)
+			continue
+		}
+		var pcomp PowerStatusComponent
+		if err := json.Unmarshal(data, &pcomp); err != nil {
+			p.Logger.Error(err)
+			continue
+		}
+		pstats.Status = append(pstats.Status, pcomp)
+	}
+	return pstats, rows.Err()
+}
+
+// WatchPowerStatus subscribes to the "power_status_changes" channel via
+// Postgres LISTEN/NOTIFY and resolves each notified xname back into a full
+// PowerStatusEvent. Unlike the ETCD driver it can't tell PUT from DELETE (or
+// supply a Previous value) from the notification alone, so every change is
+// reported with the current row state, or as a DELETE if the row is gone.
+func (p *PostgresStorage) WatchPowerStatus(ctx context.Context, xnamePrefix string) (<-chan PowerStatusEvent, error) {
+	conn, err := p.pool.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Exec(ctx, `LISTEN power_status_changes`); err != nil {
+		conn.Release()
+		return nil, err
+	}
+
+	out := make(chan PowerStatusEvent, 64)
+	go func() {
+		defer conn.Release()
+		defer close(out)
+		for {
+			notification, err := conn.Conn().WaitForNotification(ctx)
+			if err != nil {
+				return
+			}
+			xname := notification.Payload
+			if xnamePrefix != "" && !hasXnamePrefix(xname, xnamePrefix) {
+				continue
+			}
+			pcomp, err := p.GetPowerStatus(xname)
+			if err != nil {
+				out <- PowerStatusEvent{Type: PowerStatusEventDelete, XName: xname}
+				continue
+			}
+			cur := pcomp
+			out <- PowerStatusEvent{Type: PowerStatusEventPut, XName: xname, Current: &cur}
+		}
+	}()
+	return out, nil
+}
@@ -0,0 +1,284 @@
+// MIT License
+//
+// (C) Copyright [2022] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package storage
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// This file adds a push-notification API on top of the point-in-time
+// GetPowerStatus/GetAllPowerStatus calls so that callers (event publishers,
+// telemetry, the reconciler, etc.) no longer have to poll by hand.
+//
+// The hmetcd.Kvi interface used elsewhere in this package only exposes
+// Store/Get/Delete/GetRange -- it has no native watch primitive -- so the
+// watch here is implemented as a background poller that diffs successive
+// GetRange snapshots and fans the resulting events out to subscribers. The
+// "revision" carried on each event is therefore a logical, monotonically
+// increasing counter local to this process/prefix, not a raw ETCD revision,
+// and it does not survive a process restart: it only lets a watcher that
+// reconnects within the same process (e.g. after a transient ctx cancel)
+// replay what it missed via WatchPowerStatusFromRevision, by replaying from
+// the hub's in-memory event history rather than a durable ETCD log.
+//
+// Known limitations of this stopgap (not a native-watch implementation, and
+// not yet sufficient for a replica restarting and resuming from where it
+// left off -- only for a watcher reconnecting within the same live process):
+//   - Each poll only diffs net state against the previous poll, so a
+//     component that is added and removed again (or changes more than
+//     once) entirely within one watchPollIntervalDefault window produces no
+//     event, or only the last of its changes, not every transition.
+//   - The revision counter and history both live in hub's in-memory state,
+//     so they're gone on process restart; a telemetry/reconciler client
+//     that resumes after this process bounces cannot replay what it missed
+//     the way it could against a real ETCD watch with a durable revision.
+// A full implementation of "backed by etcd's native watch" needs a direct
+// ETCD v3 client (hmetcd.Kvi doesn't expose one); this poll loop is a
+// working stopgap, not that.
+
+const (
+	watchPollIntervalDefault = 2 * time.Second
+	watchHistoryLimit        = 256
+)
+
+// PowerStatusEventType identifies what happened to a watched key.
+type PowerStatusEventType string
+
+const (
+	PowerStatusEventPut    PowerStatusEventType = "PUT"
+	PowerStatusEventDelete PowerStatusEventType = "DELETE"
+)
+
+// PowerStatusEvent describes a single change to a PowerStatusComponent as
+// observed by WatchPowerStatus.
+type PowerStatusEvent struct {
+	Type     PowerStatusEventType
+	XName    string
+	Previous *PowerStatusComponent
+	Current  *PowerStatusComponent
+	Revision int64
+}
+
+// powerStatusWatcher is one subscriber's view of a watch: its output channel
+// plus the xname prefix it cares about.
+type powerStatusWatcher struct {
+	id     uint64
+	prefix string
+	ch     chan PowerStatusEvent
+}
+
+// powerStatusWatchHub owns the single background poller and fans its events
+// out to every subscriber whose prefix matches. The poll loop's lifetime is
+// tied to the hub itself (via ctx/cancel below), not to any one subscriber's
+// context, so cancelling one caller's watch never affects the others; the
+// loop is only stopped once the last watcher goes away.
+type powerStatusWatchHub struct {
+	mutex     sync.Mutex
+	nextID    uint64
+	watchers  map[uint64]*powerStatusWatcher
+	lastState map[string]PowerStatusComponent
+	revision  int64
+	started   bool
+	history   []PowerStatusEvent
+	ctx       context.Context
+	cancel    context.CancelFunc
+}
+
+// WatchPowerStatus returns a channel of PowerStatusEvent for every xname
+// whose name has the given prefix ("" matches every xname in the cluster).
+// The channel is closed and the underlying subscription torn down when ctx
+// is cancelled. Multiple concurrent watchers (even on overlapping prefixes)
+// share a single underlying poll loop.
+func (e *ETCDStorage) WatchPowerStatus(ctx context.Context, xnamePrefix string) (<-chan PowerStatusEvent, error) {
+	return e.WatchPowerStatusFromRevision(ctx, xnamePrefix, 0)
+}
+
+// WatchPowerStatusFromRevision is WatchPowerStatus, but first replays any
+// buffered events with Revision > fromRevision (up to watchHistoryLimit of
+// them) before attaching the caller as a live subscriber, so a watcher that
+// reconnects after a brief disconnect can resume roughly where it left off.
+// Pass fromRevision 0 (as WatchPowerStatus does) for a watch with no replay.
+func (e *ETCDStorage) WatchPowerStatusFromRevision(ctx context.Context, xnamePrefix string, fromRevision int64) (<-chan PowerStatusEvent, error) {
+	e.watchHubMutex.Lock()
+	if e.watchHub == nil {
+		e.watchHub = &powerStatusWatchHub{
+			watchers:  make(map[uint64]*powerStatusWatcher),
+			lastState: make(map[string]PowerStatusComponent),
+		}
+	}
+	hub := e.watchHub
+	e.watchHubMutex.Unlock()
+
+	hub.mutex.Lock()
+	hub.nextID++
+	w := &powerStatusWatcher{
+		id:     hub.nextID,
+		prefix: xnamePrefix,
+		ch:     make(chan PowerStatusEvent, 64),
+	}
+	hub.watchers[w.id] = w
+	needStart := !hub.started
+	if needStart {
+		hub.ctx, hub.cancel = context.WithCancel(context.Background())
+		hub.started = true
+	}
+	hubCtx := hub.ctx
+
+	if fromRevision > 0 {
+		for _, ev := range hub.history {
+			if ev.Revision <= fromRevision {
+				continue
+			}
+			if ev.Type == PowerStatusEventPut || ev.Type == PowerStatusEventDelete {
+				if w.prefix != "" && !hasXnamePrefix(ev.XName, w.prefix) {
+					continue
+				}
+				select {
+				case w.ch <- ev:
+				default:
+					e.Logger.Warn("WatchPowerStatus: subscriber channel full, dropping replayed event for ", ev.XName)
+				}
+			}
+		}
+	}
+	hub.mutex.Unlock()
+
+	if needStart {
+		go e.runPowerStatusWatchLoop(hubCtx, hub)
+	}
+
+	go func() {
+		<-ctx.Done()
+		hub.mutex.Lock()
+		delete(hub.watchers, w.id)
+		if len(hub.watchers) == 0 && hub.cancel != nil {
+			hub.cancel()
+			hub.started = false
+		}
+		hub.mutex.Unlock()
+		close(w.ch)
+	}()
+
+	return w.ch, nil
+}
+
+// runPowerStatusWatchLoop polls GetAllPowerStatus on an interval, diffs it
+// against the last known state, and publishes the resulting events to every
+// subscriber whose prefix matches. It runs for the hub's lifetime and exits
+// once ctx (the hub's own context, cancelled when the last watcher departs)
+// is cancelled -- never when an individual subscriber's context is cancelled.
+func (e *ETCDStorage) runPowerStatusWatchLoop(ctx context.Context, hub *powerStatusWatchHub) {
+	ticker := time.NewTicker(watchPollIntervalDefault)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			e.pollPowerStatusOnce(hub)
+		}
+	}
+}
+
+func (e *ETCDStorage) pollPowerStatusOnce(hub *powerStatusWatchHub) {
+	pstats, err := e.GetAllPowerStatus()
+	if err != nil {
+		e.Logger.Error(err)
+		return
+	}
+
+	current := make(map[string]PowerStatusComponent, len(pstats.Status))
+	for _, pcomp := range pstats.Status {
+		current[pcomp.XName] = pcomp
+	}
+
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	for xname, pcomp := range current {
+		prev, existed := hub.lastState[xname]
+		if !existed {
+			hub.revision++
+			cur := pcomp
+			e.publishEventLocked(hub, PowerStatusEvent{
+				Type:     PowerStatusEventPut,
+				XName:    xname,
+				Current:  &cur,
+				Revision: hub.revision,
+			})
+		} else if prev != pcomp {
+			hub.revision++
+			p := prev
+			cur := pcomp
+			e.publishEventLocked(hub, PowerStatusEvent{
+				Type:     PowerStatusEventPut,
+				XName:    xname,
+				Previous: &p,
+				Current:  &cur,
+				Revision: hub.revision,
+			})
+		}
+	}
+	for xname, pcomp := range hub.lastState {
+		if _, stillPresent := current[xname]; !stillPresent {
+			hub.revision++
+			p := pcomp
+			e.publishEventLocked(hub, PowerStatusEvent{
+				Type:     PowerStatusEventDelete,
+				XName:    xname,
+				Previous: &p,
+				Revision: hub.revision,
+			})
+		}
+	}
+	hub.lastState = current
+}
+
+// publishEventLocked sends ev to every watcher whose prefix matches and
+// records it in the hub's replay history. Callers must hold hub.mutex. A
+// full subscriber channel drops the event rather than blocking the poll
+// loop for every other subscriber.
+func (e *ETCDStorage) publishEventLocked(hub *powerStatusWatchHub, ev PowerStatusEvent) {
+	hub.history = append(hub.history, ev)
+	if len(hub.history) > watchHistoryLimit {
+		hub.history = hub.history[len(hub.history)-watchHistoryLimit:]
+	}
+
+	for _, w := range hub.watchers {
+		if w.prefix != "" && !hasXnamePrefix(ev.XName, w.prefix) {
+			continue
+		}
+		select {
+		case w.ch <- ev:
+		default:
+			e.Logger.Warn("WatchPowerStatus: subscriber channel full, dropping event for ", ev.XName)
+		}
+	}
+}
+
+func hasXnamePrefix(xname, prefix string) bool {
+	return len(xname) >= len(prefix) && xname[:len(prefix)] == prefix
+}
@@ -0,0 +1,116 @@
+// MIT License
+//
+// (C) Copyright [2022] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package storage
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// TestWatchPowerStatusSurvivesOtherSubscriberCancel ensures that cancelling
+// one subscriber's watch context does not tear down the shared poll loop out
+// from under the other subscribers still attached to the hub.
+func TestWatchPowerStatusSurvivesOtherSubscriberCancel(t *testing.T) {
+	b := &ETCDStorage{memOnly: true}
+	if err := b.Init(logrus.New()); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	if _, err := b.WatchPowerStatus(ctx1, ""); err != nil {
+		t.Fatalf("WatchPowerStatus (first): %v", err)
+	}
+
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	defer cancel2()
+	events2, err := b.WatchPowerStatus(ctx2, "")
+	if err != nil {
+		t.Fatalf("WatchPowerStatus (second): %v", err)
+	}
+
+	// Cancel the first subscriber and give its teardown goroutine a chance
+	// to run before driving a poll.
+	cancel1()
+	time.Sleep(50 * time.Millisecond)
+
+	xname := "x0c0s0b0n0"
+	if err := b.StorePowerStatus(PowerStatusComponent{XName: xname}); err != nil {
+		t.Fatalf("StorePowerStatus: %v", err)
+	}
+	b.pollPowerStatusOnce(b.watchHub)
+
+	select {
+	case ev, ok := <-events2:
+		if !ok {
+			t.Fatalf("second subscriber's channel was closed after the first subscriber's context was cancelled")
+		}
+		if ev.XName != xname {
+			t.Errorf("got event for %q, want %q", ev.XName, xname)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("second subscriber never received an event after the first subscriber's context was cancelled -- shared poll loop appears to have died with it")
+	}
+}
+
+// TestWatchPowerStatusFromRevisionReplayDoesNotBlock ensures that replaying
+// more buffered history than a fresh watcher's channel can hold does not
+// deadlock the caller (or, by extension, every other subscriber relying on
+// the same hub.mutex).
+func TestWatchPowerStatusFromRevisionReplayDoesNotBlock(t *testing.T) {
+	b := &ETCDStorage{memOnly: true}
+	if err := b.Init(logrus.New()); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+
+	// Establish the hub, then drive more than one watcher channel's worth
+	// of events into its replay history without anyone around to drain
+	// them.
+	if _, err := b.WatchPowerStatus(context.Background(), ""); err != nil {
+		t.Fatalf("WatchPowerStatus: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		xname := fmt.Sprintf("x0c0s0b0n%d", i)
+		if err := b.StorePowerStatus(PowerStatusComponent{XName: xname}); err != nil {
+			t.Fatalf("StorePowerStatus: %v", err)
+		}
+		b.pollPowerStatusOnce(b.watchHub)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		if _, err := b.WatchPowerStatusFromRevision(context.Background(), "", 1); err != nil {
+			t.Errorf("WatchPowerStatusFromRevision: %v", err)
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("WatchPowerStatusFromRevision blocked replaying history into an undrained channel")
+	}
+}